@@ -0,0 +1,274 @@
+package caddy_docker_upstreams
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	AddressFamilyAuto = "auto"
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// exposedPort returns the only TCP port exposed by the container.
+func exposedPort(c types.Container) (string, error) {
+	var ports []uint16
+	seen := make(map[uint16]bool)
+	for _, p := range c.Ports {
+		// The port is listed once per published host address.
+		if p.Type != "tcp" || seen[p.PrivatePort] {
+			continue
+		}
+		seen[p.PrivatePort] = true
+		ports = append(ports, p.PrivatePort)
+	}
+
+	switch len(ports) {
+	case 0:
+		return "", errors.New("unable to get port from container labels or exposed ports")
+	case 1:
+		return strconv.Itoa(int(ports[0])), nil
+	default:
+		return "", fmt.Errorf("container exposes multiple ports %v, unable to choose one without the %s label", ports, LabelUpstreamPort)
+	}
+}
+
+// upstreamPorts returns the ports to dial the container.
+func (u *Upstreams) upstreamPorts(c types.Container) ([]string, error) {
+	value, ok := c.Labels[LabelUpstreamPort]
+	if !ok {
+		if u.DefaultPort != "" {
+			return []string{u.DefaultPort}, nil
+		}
+		port, err := exposedPort(c)
+		if err != nil {
+			return nil, err
+		}
+		return []string{port}, nil
+	}
+
+	ports, err := splitValues(value)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s label: %w", LabelUpstreamPort, err)
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("empty %s label", LabelUpstreamPort)
+	}
+	for _, port := range ports {
+		if _, _, err := splitPort(port); err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// detectScheme returns the scheme of the container without the scheme label,
+// which is https if the container is dialed only on the port 443 and http otherwise.
+func (u *Upstreams) detectScheme(c types.Container) string {
+	if _, ok := c.Labels[LabelUpstreamDial]; ok {
+		return "http"
+	}
+
+	ports, err := u.upstreamPorts(c)
+	if err != nil {
+		return "http"
+	}
+	for _, port := range ports {
+		if number, proto, _ := splitPort(port); number != "443" || proto != "tcp" {
+			return "http"
+		}
+	}
+	return "https"
+}
+
+// splitPort splits the port like 8080/udp into the number and the protocol, which is tcp by default.
+func splitPort(port string) (string, string, error) {
+	number, proto, found := strings.Cut(port, "/")
+	if !found {
+		proto = "tcp"
+	}
+	if number == "" || (proto != "tcp" && proto != "udp") {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	return number, proto, nil
+}
+
+// joinAddress returns the network address of the host and the port,
+// the udp ports are prefixed by the network like udp/host:port.
+func joinAddress(host, port string) string {
+	number, proto, _ := splitPort(port)
+	address := net.JoinHostPort(host, number)
+	if proto == "udp" {
+		address = "udp/" + address
+	}
+	return address
+}
+
+// publishedAddress returns the host address which the container port is published to.
+func (u *Upstreams) publishedAddress(c types.Container, port string) (string, error) {
+	number, proto, err := splitPort(port)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range c.Ports {
+		if p.Type != proto || strconv.Itoa(int(p.PrivatePort)) != number || p.PublicPort == 0 {
+			continue
+		}
+
+		// Dial the docker host if the port is published to all interfaces.
+		host := u.HostIP
+		if ip := net.ParseIP(p.IP); ip != nil && !ip.IsUnspecified() {
+			host = p.IP
+		}
+		return joinAddress(host, fmt.Sprintf("%d/%s", p.PublicPort, proto)), nil
+	}
+
+	return "", fmt.Errorf("container port %s is not published", port)
+}
+
+// networkIP returns the ip address of the container in the chosen network.
+func (u *Upstreams) networkIP(c types.Container) (string, error) {
+	// The container shares the network stack of the docker host.
+	if c.HostConfig.NetworkMode == "host" {
+		return u.HostIP, nil
+	}
+
+	if c.NetworkSettings == nil || len(c.NetworkSettings.Networks) == 0 {
+		return "", errors.New("unable to get ip address from container networks")
+	}
+
+	network, ok := c.Labels[LabelNetwork]
+	if !ok && u.Network != "" {
+		network, ok = u.Network, true
+	}
+	if !ok {
+		// Use the first network of container by name, the map order is random.
+		names := make([]string, 0, len(c.NetworkSettings.Networks))
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		network = names[0]
+	}
+
+	settings, ok := c.NetworkSettings.Networks[network]
+	if !ok {
+		// Add project prefix. See also https://github.com/compose-spec/compose-go/blob/main/loader/normalize.go.
+		// The networks of a docker stack are prefixed by the stack name likewise.
+		project, ok := c.Labels[composeProjectLabel]
+		if !ok {
+			project, ok = c.Labels[stackNamespaceLabel]
+		}
+		if !ok {
+			return "", fmt.Errorf("container is not attached to network %q", network)
+		}
+
+		network = fmt.Sprintf("%s_%s", project, network)
+		settings, ok = c.NetworkSettings.Networks[network]
+		if !ok {
+			return "", fmt.Errorf("container is not attached to network %q", network)
+		}
+	}
+
+	switch u.AddressFamily {
+	case AddressFamilyIPv4:
+		if settings.IPAddress != "" {
+			return settings.IPAddress, nil
+		}
+		return "", fmt.Errorf("container has no ipv4 address in network %q", network)
+	case AddressFamilyIPv6:
+		if settings.GlobalIPv6Address != "" {
+			return settings.GlobalIPv6Address, nil
+		}
+		return "", fmt.Errorf("container has no ipv6 address in network %q", network)
+	}
+
+	// Fall back to IPv6 for the IPv6-only networks.
+	switch {
+	case settings.IPAddress != "":
+		return settings.IPAddress, nil
+	case settings.GlobalIPv6Address != "":
+		return settings.GlobalIPv6Address, nil
+	default:
+		return "", fmt.Errorf("container has no ip address in network %q", network)
+	}
+}
+
+// upstreamAddresses returns the addresses to dial the container, one per port.
+func (u *Upstreams) upstreamAddresses(c types.Container) ([]string, error) {
+	// The dial label bypasses the port and network resolution.
+	if dial, ok := c.Labels[LabelUpstreamDial]; ok {
+		if dial = strings.TrimSpace(dial); dial == "" {
+			return nil, fmt.Errorf("empty %s label", LabelUpstreamDial)
+		}
+		return []string{dial}, nil
+	}
+
+	ports, err := u.upstreamPorts(c)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(ports))
+
+	if value, ok := c.Labels[LabelUpstreamPublished]; ok {
+		published, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s label: %w", LabelUpstreamPublished, err)
+		}
+		if published {
+			for _, port := range ports {
+				address, err := u.publishedAddress(c, port)
+				if err != nil {
+					return nil, err
+				}
+				addresses = append(addresses, address)
+			}
+			return addresses, nil
+		}
+	}
+
+	if value, ok := c.Labels[LabelUpstreamUseName]; ok {
+		useName, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s label: %w", LabelUpstreamUseName, err)
+		}
+		if useName {
+			// The name is resolved by the embedded DNS of the shared docker network.
+			name := containerName(c)
+			if name == "" {
+				return nil, errors.New("unable to get name of container")
+			}
+			for _, port := range ports {
+				addresses = append(addresses, joinAddress(name, port))
+			}
+			return addresses, nil
+		}
+	}
+
+	// Choose network to connect, unless the ip address is pinned.
+	ip, ok := c.Labels[LabelUpstreamIP]
+	if ok {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid %s label %q", LabelUpstreamIP, ip)
+		}
+	} else {
+		ip, err = u.networkIP(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, port := range ports {
+		addresses = append(addresses, joinAddress(ip, port))
+	}
+	return addresses, nil
+}
@@ -0,0 +1,224 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// instances holds the provisioned upstreams modules, which are read by the admin API.
+var instances = struct {
+	sync.Mutex
+	m map[*Upstreams]struct{}
+}{m: make(map[*Upstreams]struct{})}
+
+func registerInstance(u *Upstreams) {
+	instances.Lock()
+	instances.m[u] = struct{}{}
+	instances.Unlock()
+}
+
+func unregisterInstance(u *Upstreams) {
+	instances.Lock()
+	delete(instances.m, u)
+	instances.Unlock()
+}
+
+// adminAPI is a module that serves the discovered containers on the admin API.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.docker_upstreams",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes of the docker upstreams.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/docker-upstreams/containers",
+			Handler: caddy.AdminHandlerFunc(a.handleContainers),
+		},
+		{
+			Pattern: "/docker-upstreams/hosts",
+			Handler: caddy.AdminHandlerFunc(a.handleHosts),
+		},
+		{
+			Pattern: "/docker-upstreams/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+	}
+}
+
+type containerInfo struct {
+	Host        string            `json:"host,omitempty"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Upstreams   []string          `json:"upstreams"`
+	Scheme      string            `json:"scheme"`
+	Weight      int               `json:"weight"`
+	HealthPath  string            `json:"health_path,omitempty"`
+	H2C         bool              `json:"h2c,omitempty"`
+	DialTimeout string            `json:"dial_timeout,omitempty"`
+}
+
+func (u *Upstreams) containerInfos() []containerInfo {
+	u.candidatesMu.RLock()
+	defer u.candidatesMu.RUnlock()
+
+	infos := make([]containerInfo, 0, len(u.candidates))
+	for _, c := range u.candidates {
+		dials := make([]string, 0, len(c.upstreams))
+		for _, upstream := range c.upstreams {
+			dials = append(dials, upstream.Dial)
+		}
+		var dialTimeout string
+		if c.dialTimeout > 0 {
+			dialTimeout = c.dialTimeout.String()
+		}
+		infos = append(infos, containerInfo{
+			Host:        c.host,
+			ID:          c.id,
+			Name:        c.name,
+			Labels:      c.labels,
+			Upstreams:   dials,
+			Scheme:      c.scheme,
+			Weight:      c.weight,
+			HealthPath:  c.healthPath,
+			H2C:         c.h2c,
+			DialTimeout: dialTimeout,
+		})
+	}
+	return infos
+}
+
+type hostInfo struct {
+	Host        string     `json:"host,omitempty"`
+	Containers  int        `json:"containers"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (u *Upstreams) hostInfos() []hostInfo {
+	u.candidatesMu.RLock()
+	defer u.candidatesMu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, c := range u.candidates {
+		counts[c.host]++
+	}
+
+	infos := make([]hostInfo, 0, len(u.hosts))
+	for _, h := range u.hosts {
+		lastRefresh, lastError, lastErrorAt := h.watcher.status()
+		info := hostInfo{
+			Host:       h.name,
+			Containers: counts[h.name],
+			LastError:  lastError,
+		}
+		if !lastRefresh.IsZero() {
+			info.LastRefresh = &lastRefresh
+		}
+		if !lastErrorAt.IsZero() {
+			info.LastErrorAt = &lastErrorAt
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// handleContainers returns the containers known by all the upstreams modules.
+func (a *adminAPI) handleContainers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	infos := make([]containerInfo, 0)
+	instances.Lock()
+	for u := range instances.m {
+		infos = append(infos, u.containerInfos()...)
+	}
+	instances.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(infos)
+}
+
+// handleHosts returns the discovery status of the docker hosts of all the upstreams modules.
+func (a *adminAPI) handleHosts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	infos := make([]hostInfo, 0)
+	instances.Lock()
+	for u := range instances.m {
+		infos = append(infos, u.hostInfos()...)
+	}
+	instances.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(infos)
+}
+
+// handleHealth responds 200 if at least min (1 by default) containers are discovered
+// by all the upstreams modules, 503 otherwise.
+func (a *adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	threshold := 1
+	if value := r.URL.Query().Get("min"); value != "" {
+		var err error
+		threshold, err = strconv.Atoi(value)
+		if err != nil || threshold < 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid min value %q", value),
+			}
+		}
+	}
+
+	count := 0
+	instances.Lock()
+	for u := range instances.m {
+		u.candidatesMu.RLock()
+		count += len(u.candidates)
+		u.candidatesMu.RUnlock()
+	}
+	instances.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if count < threshold {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(map[string]int{"containers": count, "min": threshold})
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
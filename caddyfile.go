@@ -1,17 +1,227 @@
 package caddy_docker_upstreams
 
-import "github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
 
 // UnmarshalCaddyfile deserializes Caddyfile tokens into u.
 //
-//	dynamic docker
+//	dynamic docker {
+//		host <url>
+//		hosts <url>...
+//		tls_ca_cert <path>
+//		tls_cert <path>
+//		tls_key <path>
+//		api_version <version>
+//		require_healthy <bool>
+//		backend docker|podman
+//		mode containers|swarm
+//		label_prefix <prefix>
+//		max_retry_interval <duration>
+//		label_filter <key> <value>
+//		network <network>
+//		host_group <name> <host>...
+//		include_names <pattern>...
+//		exclude_names <pattern>...
+//		compose_project <project>
+//		provision_retries <count>
+//		fail_fast <bool>
+//		watch_network_events
+//		poll_interval <duration>
+//		refresh_debounce <duration>
+//		request_timeout <duration>
+//		host_ip <ip>
+//		address_family auto|ipv4|ipv6
+//		default_port <port>
+//		strict_labels
+//		expand_labels
+//	}
 func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		if d.NextArg() {
 			return d.ArgErr()
 		}
-		if d.NextBlock(0) {
-			return d.Errf("unrecognized docker option '%s'", d.Val())
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "host":
+				if !d.AllArgs(&u.Host) {
+					return d.ArgErr()
+				}
+			case "hosts":
+				hosts := d.RemainingArgs()
+				if len(hosts) == 0 {
+					return d.ArgErr()
+				}
+				u.Hosts = append(u.Hosts, hosts...)
+			case "tls_ca_cert":
+				if !d.AllArgs(&u.TLSCACert) {
+					return d.ArgErr()
+				}
+			case "tls_cert":
+				if !d.AllArgs(&u.TLSCert) {
+					return d.ArgErr()
+				}
+			case "tls_key":
+				if !d.AllArgs(&u.TLSKey) {
+					return d.ArgErr()
+				}
+			case "api_version":
+				if !d.AllArgs(&u.APIVersion) {
+					return d.ArgErr()
+				}
+			case "require_healthy":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				requireHealthy, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("invalid require_healthy value '%s': %v", value, err)
+				}
+				u.RequireHealthy = &requireHealthy
+			case "mode":
+				if !d.AllArgs(&u.Mode) {
+					return d.ArgErr()
+				}
+			case "backend":
+				if !d.AllArgs(&u.Backend) {
+					return d.ArgErr()
+				}
+			case "label_prefix":
+				if !d.AllArgs(&u.LabelPrefix) {
+					return d.ArgErr()
+				}
+			case "max_retry_interval":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid max_retry_interval value '%s': %v", value, err)
+				}
+				u.MaxRetryInterval = caddy.Duration(interval)
+			case "label_filter":
+				var key, value string
+				if !d.AllArgs(&key, &value) {
+					return d.ArgErr()
+				}
+				if u.ExtraLabelFilters == nil {
+					u.ExtraLabelFilters = make(map[string]string)
+				}
+				u.ExtraLabelFilters[key] = value
+			case "fail_fast":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				failFast, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("invalid fail_fast value '%s': %v", value, err)
+				}
+				u.FailFast = &failFast
+			case "poll_interval":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid poll_interval value '%s': %v", value, err)
+				}
+				u.PollInterval = caddy.Duration(interval)
+			case "refresh_debounce":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				delay, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid refresh_debounce value '%s': %v", value, err)
+				}
+				u.RefreshDebounce = caddy.Duration(delay)
+			case "request_timeout":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid request_timeout value '%s': %v", value, err)
+				}
+				u.RequestTimeout = caddy.Duration(timeout)
+			case "host_ip":
+				if !d.AllArgs(&u.HostIP) {
+					return d.ArgErr()
+				}
+			case "network":
+				if !d.AllArgs(&u.Network) {
+					return d.ArgErr()
+				}
+			case "host_group":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				if u.HostGroups == nil {
+					u.HostGroups = make(map[string][]string)
+				}
+				u.HostGroups[args[0]] = append(u.HostGroups[args[0]], args[1:]...)
+			case "include_names":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				u.IncludeNames = append(u.IncludeNames, names...)
+			case "exclude_names":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				u.ExcludeNames = append(u.ExcludeNames, names...)
+			case "compose_project":
+				if !d.AllArgs(&u.ComposeProject) {
+					return d.ArgErr()
+				}
+			case "address_family":
+				if !d.AllArgs(&u.AddressFamily) {
+					return d.ArgErr()
+				}
+			case "default_port":
+				if !d.AllArgs(&u.DefaultPort) {
+					return d.ArgErr()
+				}
+			case "provision_retries":
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				retries, err := strconv.Atoi(value)
+				if err != nil || retries < 0 {
+					return d.Errf("invalid provision_retries value '%s'", value)
+				}
+				u.ProvisionRetries = &retries
+			case "watch_network_events":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.WatchNetworkEvents = true
+			case "strict_labels":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.StrictLabels = true
+			case "expand_labels":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				u.ExpandLabels = true
+			default:
+				return d.Errf("unrecognized docker option '%s'", d.Val())
+			}
 		}
 	}
 	return nil
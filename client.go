@@ -0,0 +1,70 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// ContainerLister lists the containers, and the services and tasks in swarm mode.
+type ContainerLister interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+}
+
+// EventWatcher monitors the events which could change the listed containers.
+type EventWatcher interface {
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// Client is the docker client used by the module, which is implemented by *client.Client
+// and could be replaced by the alternative backends with the NewClient field.
+type Client interface {
+	ContainerLister
+	EventWatcher
+
+	Ping(ctx context.Context) (types.Ping, error)
+	NegotiateAPIVersionPing(ping types.Ping)
+	ClientVersion() string
+	DaemonHost() string
+	Close() error
+}
+
+// clients holds the docker clients shared by the upstreams modules, so the clients
+// are kept while the config is reloaded and closed once the last module is cleaned up.
+var clients = caddy.NewUsagePool()
+
+// sharedClient closes the client when it is deleted from the pool for the last time.
+type sharedClient struct {
+	Client
+}
+
+func (c sharedClient) Destruct() error {
+	return c.Close()
+}
+
+func loadClient(key string, newClient func() (Client, error)) (Client, error) {
+	value, _, err := clients.LoadOrNew(key, func() (caddy.Destructor, error) {
+		cli, err := newClient()
+		if err != nil {
+			return nil, err
+		}
+		return sharedClient{cli}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(sharedClient).Client, nil
+}
+
+// Interface guards
+var (
+	_ Client           = (*client.Client)(nil)
+	_ caddy.Destructor = sharedClient{}
+)
@@ -0,0 +1,157 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "docker-upstreams",
+		Usage: "[--config <path> [--adapter <name>]] [--host <url>] [--mode containers|swarm] [--label-prefix <prefix>]",
+		Short: "Lists the containers which would be discovered as upstreams",
+		Long: `
+Connects to the docker server, lists the enabled containers and prints the
+discovered containers with their upstreams as JSON, then exits.
+
+With --config, the options of every dynamic docker upstream source in the
+config are used, like the host groups, the networks and the label filters,
+and the other flags override the options of all the sources.
+
+The containers with invalid labels are logged and skipped, and the command
+exits with an error if there is any. Useful to check the labels before
+deploying them.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("config", "c", "", "Configuration file with the dynamic docker upstream sources")
+			cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.Flags().String("host", "", "The URL to the docker server")
+			cmd.Flags().String("mode", "", "The kind of docker objects to discover")
+			cmd.Flags().String("label-prefix", "", "The prefix of the labels to read")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdDockerUpstreams)
+		},
+	})
+}
+
+func cmdDockerUpstreams(fs caddycmd.Flags) (int, error) {
+	sources := []*Upstreams{{}}
+	if configFile := fs.String("config"); configFile != "" {
+		config, _, err := caddycmd.LoadConfig(configFile, fs.String("adapter"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		sources, err = dockerSources(config)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if len(sources) == 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("no dynamic docker upstream source in %s", configFile)
+		}
+	} else if fs.String("adapter") != "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--adapter requires --config")
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	infos := make([]containerInfo, 0)
+	var errs []error
+	for i, u := range sources {
+		if host := fs.String("host"); host != "" {
+			u.Host, u.Hosts = host, nil
+		}
+		if mode := fs.String("mode"); mode != "" {
+			u.Mode = mode
+		}
+		if prefix := fs.String("label-prefix"); prefix != "" {
+			u.LabelPrefix = prefix
+		}
+		failFast := true
+		u.FailFast = &failFast
+		u.StrictLabels = true
+
+		defer u.Cleanup()
+		err := u.Provision(ctx)
+		if u.candidatesMu != nil {
+			infos = append(infos, u.containerInfos()...)
+		}
+		if err != nil {
+			if len(sources) > 1 {
+				err = fmt.Errorf("source %d: %w", i, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(infos); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(errs) > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("discovering containers: %w", errors.Join(errs...))
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// dockerSources returns the options of the dynamic docker upstream sources in
+// the JSON config, ordered by their path in the config.
+func dockerSources(config []byte) ([]*Upstreams, error) {
+	var root any
+	if err := json.Unmarshal(config, &root); err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+
+	var sources []*Upstreams
+	var walk func(v any) error
+	walk = func(v any) error {
+		switch v := v.(type) {
+		case []any:
+			for _, e := range v {
+				if err := walk(e); err != nil {
+					return err
+				}
+			}
+		case map[string]any:
+			if source, ok := v["dynamic_upstreams"].(map[string]any); ok && source["source"] == "docker" {
+				raw, err := json.Marshal(source)
+				if err != nil {
+					return err
+				}
+				u := new(Upstreams)
+				if err := json.Unmarshal(raw, u); err != nil {
+					return fmt.Errorf("decoding docker upstream source: %w", err)
+				}
+				sources = append(sources, u)
+			}
+			// The map order is random, walk the keys in order for a stable order of sources.
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if key == "dynamic_upstreams" {
+					continue
+				}
+				if err := walk(v[key]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
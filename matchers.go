@@ -1,20 +1,42 @@
 package caddy_docker_upstreams
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"go.uber.org/zap"
 )
 
 const (
 	LabelMatchProtocol   = "com.caddyserver.http.matchers.protocol"
 	LabelMatchHost       = "com.caddyserver.http.matchers.host"
+	LabelMatchHostPort   = "com.caddyserver.http.matchers.host_port"
 	LabelMatchMethod     = "com.caddyserver.http.matchers.method"
 	LabelMatchPath       = "com.caddyserver.http.matchers.path"
+	LabelMatchPathRegexp = "com.caddyserver.http.matchers.path_regexp"
 	LabelMatchQuery      = "com.caddyserver.http.matchers.query"
+	LabelMatchRemoteIP   = "com.caddyserver.http.matchers.remote_ip"
+	LabelMatchHeader     = "com.caddyserver.http.matchers.header"
 	LabelMatchExpression = "com.caddyserver.http.matchers.expression"
+	LabelMatchClientCN   = "com.caddyserver.http.matchers.client_cn"
+	LabelMatchScheme     = "com.caddyserver.http.matchers.scheme"
+	LabelMatchSNI        = "com.caddyserver.http.matchers.sni"
+
+	LabelMatchGRPCService   = "com.caddyserver.http.matchers.grpc_service"
+	LabelMatchContentLength = "com.caddyserver.http.matchers.content_length"
+	LabelMatchCookie        = "com.caddyserver.http.matchers.cookie"
+)
+
+const (
+	labelMatchPrefix    = "com.caddyserver.http.matchers."
+	labelMatchNotPrefix = "com.caddyserver.http.matchers.not."
 )
 
 var producers = map[string]func(string) (caddyhttp.RequestMatcher, error){
@@ -22,59 +44,336 @@ var producers = map[string]func(string) (caddyhttp.RequestMatcher, error){
 		return caddyhttp.MatchProtocol(value), nil
 	},
 	LabelMatchHost: func(value string) (caddyhttp.RequestMatcher, error) {
-		return caddyhttp.MatchHost{value}, nil
+		hosts, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		return caddyhttp.MatchHost(hosts), nil
+	},
+	LabelMatchHostPort: func(value string) (caddyhttp.RequestMatcher, error) {
+		// Unlike MatchHost, the Host header is matched as is, including the port.
+		hosts, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		return caddyhttp.MatchHeader{"Host": hosts}, nil
 	},
 	LabelMatchMethod: func(value string) (caddyhttp.RequestMatcher, error) {
-		return caddyhttp.MatchMethod{value}, nil
+		methods, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(methods) == 0 {
+			// An empty method list is ignored rather than matching nothing.
+			return nil, nil
+		}
+		for i, method := range methods {
+			methods[i] = strings.ToUpper(method)
+		}
+		return caddyhttp.MatchMethod(methods), nil
 	},
 	LabelMatchPath: func(value string) (caddyhttp.RequestMatcher, error) {
 		return caddyhttp.MatchPath{value}, nil
 	},
+	LabelMatchPathRegexp: func(value string) (caddyhttp.RequestMatcher, error) {
+		// The value is either a pattern or name=pattern, the name is used
+		// by the placeholders like {http.regexp.name.1}.
+		var name string
+		if n, pattern, ok := strings.Cut(value, "="); ok && isRegexpName(n) {
+			name, value = n, pattern
+		}
+		return &caddyhttp.MatchPathRE{MatchRegexp: caddyhttp.MatchRegexp{Name: name, Pattern: value}}, nil
+	},
 	LabelMatchQuery: func(value string) (caddyhttp.RequestMatcher, error) {
 		query, err := url.ParseQuery(value)
 		if err != nil {
 			return nil, err
 		}
+		// A bare key matches the query parameter with any value.
+		for _, pair := range strings.Split(value, "&") {
+			if pair == "" || strings.Contains(pair, "=") {
+				continue
+			}
+			key, err := url.QueryUnescape(pair)
+			if err != nil {
+				return nil, err
+			}
+			query[key] = []string{"*"}
+		}
 		return caddyhttp.MatchQuery(query), nil
 	},
+	LabelMatchRemoteIP: func(value string) (caddyhttp.RequestMatcher, error) {
+		ranges, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		return &caddyhttp.MatchRemoteIP{Ranges: ranges}, nil
+	},
+	LabelMatchHeader: func(value string) (caddyhttp.RequestMatcher, error) {
+		pairs, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		header := make(http.Header)
+		for _, pair := range pairs {
+			field, val, found := strings.Cut(pair, ":")
+			field = http.CanonicalHeaderKey(strings.TrimSpace(field))
+			if field == "" {
+				return nil, fmt.Errorf("malformed header matcher %q: expected field", pair)
+			}
+			if !found {
+				// A non-nil but empty list means the header field must exist.
+				if _, ok := header[field]; !ok {
+					header[field] = []string{}
+				}
+				continue
+			}
+			header.Add(field, strings.TrimSpace(val))
+		}
+		return caddyhttp.MatchHeader(header), nil
+	},
 	LabelMatchExpression: func(value string) (caddyhttp.RequestMatcher, error) {
 		return &caddyhttp.MatchExpression{Expr: value}, nil
 	},
+	LabelMatchClientCN: func(value string) (caddyhttp.RequestMatcher, error) {
+		names, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		return matchClientCN(names), nil
+	},
+	LabelMatchScheme: func(value string) (caddyhttp.RequestMatcher, error) {
+		if value != "http" && value != "https" {
+			return nil, fmt.Errorf("unrecognized scheme %q", value)
+		}
+		// Like the protocol matcher, the scheme is decided by the TLS connection to caddy.
+		return caddyhttp.MatchProtocol(value), nil
+	},
+	LabelMatchSNI: func(value string) (caddyhttp.RequestMatcher, error) {
+		names, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		return matchSNI(names), nil
+	},
+	LabelMatchGRPCService: func(value string) (caddyhttp.RequestMatcher, error) {
+		// The gRPC methods are requested by the path like /helloworld.Greeter/SayHello.
+		services, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+		var paths caddyhttp.MatchPath
+		for _, service := range services {
+			paths = append(paths, "/"+strings.Trim(service, "/")+"/*")
+		}
+		return paths, nil
+	},
+	LabelMatchContentLength: func(value string) (caddyhttp.RequestMatcher, error) {
+		value = strings.TrimSpace(value)
+		op := strings.TrimRight(value, "0123456789 ")
+		switch op {
+		case ">", "<", ">=", "<=":
+		default:
+			return nil, fmt.Errorf("unrecognized operator %q, expected >, <, >= or <=", op)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(value, op)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return matchContentLength{op: op, size: size}, nil
+	},
+	LabelMatchCookie: func(value string) (caddyhttp.RequestMatcher, error) {
+		name, val, found := strings.Cut(value, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("malformed cookie matcher %q: expected name", value)
+		}
+		return matchCookie{name: name, value: strings.TrimSpace(val), anyValue: !found}, nil
+	},
+}
+
+// matchClientCN matches the common name of the verified client certificate,
+// the requests without a verified client certificate are not matched.
+type matchClientCN []string
+
+func (m matchClientCN) Match(r *http.Request) bool {
+	// The peer certificates are not verified with the client_auth modes like request.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, name := range m {
+		if name == cn {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportedMatcherLabels returns the sorted matcher labels under the default prefix,
+// including the negated ones.
+func SupportedMatcherLabels() []string {
+	labels := make([]string, 0, 2*len(producers))
+	for key := range producers {
+		labels = append(labels, key, labelMatchNotPrefix+strings.TrimPrefix(key, labelMatchPrefix))
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// matchSNI matches the server name of the TLS handshake, which could differ from
+// the Host header on a reused connection. The requests without TLS are not matched.
+type matchSNI []string
+
+func (m matchSNI) Match(r *http.Request) bool {
+	if r.TLS == nil {
+		return false
+	}
+	for _, name := range m {
+		if strings.EqualFold(name, r.TLS.ServerName) {
+			return true
+		}
+	}
+	return false
 }
 
-func buildMatchers(ctx caddy.Context, labels map[string]string) caddyhttp.MatcherSet {
+// matchContentLength compares the Content-Length of the request with the size,
+// the requests of unknown length like the chunked ones are not matched.
+type matchContentLength struct {
+	op   string
+	size int64
+}
+
+func (m matchContentLength) Match(r *http.Request) bool {
+	if r.ContentLength < 0 {
+		return false
+	}
+	switch m.op {
+	case ">":
+		return r.ContentLength > m.size
+	case "<":
+		return r.ContentLength < m.size
+	case ">=":
+		return r.ContentLength >= m.size
+	case "<=":
+		return r.ContentLength <= m.size
+	}
+	return false
+}
+
+// matchCookie matches the value of the cookie, or any value if the value is not set.
+// The requests without the cookie are not matched.
+type matchCookie struct {
+	name, value string
+	anyValue    bool
+}
+
+func (m matchCookie) Match(r *http.Request) bool {
+	cookie, err := r.Cookie(m.name)
+	if err != nil {
+		return false
+	}
+	return m.anyValue || cookie.Value == m.value
+}
+
+// splitValues splits a comma separated label value, trimming whitespace
+// and dropping empty elements. A value starting with [ is decoded as a
+// JSON array of strings instead, so the elements could contain commas.
+func splitValues(value string) ([]string, error) {
+	var values []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &values); err != nil {
+			return nil, fmt.Errorf("parsing JSON array %q: %w", value, err)
+		}
+		return values, nil
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// isRegexpName reports whether s could be the name of a regexp matcher.
+func isRegexpName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// labeledMatcher is a matcher built from the container label, the label is kept for logging.
+type labeledMatcher struct {
+	caddyhttp.RequestMatcher
+	key, value string
+}
+
+func buildMatcher(ctx caddy.Context, key, value string) (caddyhttp.RequestMatcher, error) {
+	matcher, err := producers[key](value)
+	if err != nil {
+		return nil, fmt.Errorf("loading matcher %s=%q: %w", key, value, err)
+	}
+	if matcher == nil {
+		return nil, nil
+	}
+
+	if prov, ok := matcher.(caddy.Provisioner); ok {
+		err = prov.Provision(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("provisioning matcher %s=%q: %w", key, value, err)
+		}
+	}
+
+	return matcher, nil
+}
+
+func buildMatchers(ctx caddy.Context, labels map[string]string) (caddyhttp.MatcherSet, error) {
 	var matchers caddyhttp.MatcherSet
 
-	for key, producer := range producers {
+	for key := range producers {
 		value, ok := labels[key]
 		if !ok {
 			continue
 		}
 
-		matcher, err := producer(value)
+		matcher, err := buildMatcher(ctx, key, value)
 		if err != nil {
-			ctx.Logger().Error("unable to load matcher",
-				zap.String("key", key),
-				zap.String("value", value),
-				zap.Error(err),
-			)
+			return nil, err
+		}
+		if matcher == nil {
 			continue
 		}
 
-		if prov, ok := matcher.(caddy.Provisioner); ok {
-			err = prov.Provision(ctx)
-			if err != nil {
-				ctx.Logger().Error("unable to provision matcher",
-					zap.String("key", key),
-					zap.String("value", value),
-					zap.Error(err),
-				)
-				continue
-			}
+		matchers = append(matchers, labeledMatcher{matcher, key, value})
+	}
+
+	// Any matcher X is negated by the label matchers.not.X.
+	for key, value := range labels {
+		if !strings.HasPrefix(key, labelMatchNotPrefix) {
+			continue
+		}
+		inner := labelMatchPrefix + strings.TrimPrefix(key, labelMatchNotPrefix)
+		if _, ok := producers[inner]; !ok {
+			continue
+		}
+
+		matcher, err := buildMatcher(ctx, inner, value)
+		if err != nil {
+			return nil, err
+		}
+		if matcher == nil {
+			continue
 		}
 
-		matchers = append(matchers, matcher)
+		matcher = caddyhttp.MatchNot{MatcherSets: []caddyhttp.MatcherSet{{matcher}}}
+		matchers = append(matchers, labeledMatcher{matcher, key, value})
 	}
 
-	return matchers
+	return matchers, nil
 }
@@ -0,0 +1,77 @@
+package caddy_docker_upstreams
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamsMetrics = struct {
+	init              sync.Once
+	refreshes         prometheus.Counter
+	refreshErrors     prometheus.Counter
+	unmatchedRequests prometheus.Counter
+}{}
+
+func initUpstreamsMetrics() {
+	const ns, sub = "caddy", "docker_upstreams"
+
+	// The gauges are collected from the provisioned modules, so the modules of
+	// multiple configs or of the old config during a reload don't overwrite them.
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "containers",
+		Help:      "Number of enabled containers listed from the docker server.",
+	}, func() float64 {
+		return sumInstances(func(u *Upstreams) int {
+			total := 0
+			for _, h := range u.hosts {
+				total += h.containers
+			}
+			return total
+		})
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "candidates",
+		Help:      "Number of containers with valid matchers and upstream.",
+	}, func() float64 {
+		return sumInstances(func(u *Upstreams) int { return len(u.candidates) })
+	})
+	upstreamsMetrics.refreshes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "refreshes_total",
+		Help:      "Counter of refreshes triggered by docker events.",
+	})
+	upstreamsMetrics.refreshErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "refresh_errors_total",
+		Help:      "Counter of failed refreshes triggered by docker events.",
+	})
+	upstreamsMetrics.unmatchedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "unmatched_requests_total",
+		Help:      "Counter of requests without any matched upstream.",
+	})
+}
+
+// sumInstances sums the count of all the provisioned upstreams modules,
+// the count is read while holding the lock of the candidates.
+func sumInstances(count func(u *Upstreams) int) float64 {
+	instances.Lock()
+	defer instances.Unlock()
+
+	total := 0
+	for u := range instances.m {
+		u.candidatesMu.RLock()
+		total += count(u)
+		u.candidatesMu.RUnlock()
+	}
+	return float64(total)
+}
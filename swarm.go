@@ -0,0 +1,78 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+const (
+	ModeContainers = "containers"
+	ModeSwarm      = "swarm"
+)
+
+// listTasks lists the running tasks of the enabled swarm services. The tasks are
+// returned as containers labeled with the service labels, so they could be
+// handled the same way as the standalone containers.
+func (u *Upstreams) listTasks(ctx context.Context, cli ContainerLister) ([]types.Container, error) {
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{
+		Filters: u.labelFilters(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing docker services: %w", err)
+	}
+
+	var containers []types.Container
+
+	for _, service := range services {
+		tasks, err := cli.TaskList(ctx, types.TaskListOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("service", service.ID),
+				filters.Arg("desired-state", string(swarm.TaskStateRunning)),
+			),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing docker tasks of service %s: %w", service.ID, err)
+		}
+
+		for _, task := range tasks {
+			if task.Status.State != swarm.TaskStateRunning {
+				continue
+			}
+
+			networks := make(map[string]*network.EndpointSettings, len(task.NetworksAttachments))
+			for _, attachment := range task.NetworksAttachments {
+				// The ingress network only routes the published ports through the routing mesh.
+				if attachment.Network.Spec.Ingress || len(attachment.Addresses) == 0 {
+					continue
+				}
+				// The addresses are in CIDR notation.
+				address, _, _ := strings.Cut(attachment.Addresses[0], "/")
+				ip := net.ParseIP(address)
+				if ip == nil {
+					continue
+				}
+				if ip.To4() != nil {
+					networks[attachment.Network.Spec.Name] = &network.EndpointSettings{IPAddress: address}
+				} else {
+					networks[attachment.Network.Spec.Name] = &network.EndpointSettings{GlobalIPv6Address: address}
+				}
+			}
+
+			containers = append(containers, types.Container{
+				ID:              task.ID,
+				Labels:          service.Spec.Labels,
+				State:           string(task.Status.State),
+				NetworkSettings: &types.SummaryNetworkSettings{Networks: networks},
+			})
+		}
+	}
+
+	return containers, nil
+}
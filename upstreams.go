@@ -2,17 +2,25 @@ package caddy_docker_upstreams
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/bep/debounce"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/docker/cli/cli/connhelper"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
@@ -21,35 +29,274 @@ import (
 	"go.uber.org/zap"
 )
 
+// DefaultLabelPrefix is the prefix of the Label* constants.
+const DefaultLabelPrefix = "com.caddyserver.http"
+
+const (
+	LabelEnable         = "com.caddyserver.http.enable"
+	LabelNetwork        = "com.caddyserver.http.network"
+	LabelUpstreamPort   = "com.caddyserver.http.upstream.port"
+	LabelUpstreamScheme = "com.caddyserver.http.upstream.scheme"
+
+	LabelUpstreamPublished = "com.caddyserver.http.upstream.published"
+	LabelUpstreamWeight    = "com.caddyserver.http.upstream.weight"
+	LabelUpstreamDial      = "com.caddyserver.http.upstream.dial"
+
+	LabelUpstreamMaxRequests = "com.caddyserver.http.upstream.max_requests"
+	LabelUpstreamUseName     = "com.caddyserver.http.upstream.use_name"
+	LabelUpstreamH2C         = "com.caddyserver.http.upstream.h2c"
+	LabelUpstreamIP          = "com.caddyserver.http.upstream.ip"
+	LabelUpstreamDialTimeout = "com.caddyserver.http.upstream.dial_timeout"
+	LabelUpstreamStripPrefix = "com.caddyserver.http.upstream.strip_prefix"
+
+	LabelHealthPath = "com.caddyserver.http.health.path"
+	LabelReady      = "com.caddyserver.http.ready"
+)
+
+// The placeholders set by GetUpstreams for the handlers of reverse_proxy.
 const (
-	LabelEnable       = "com.caddyserver.http.enable"
-	LabelNetwork      = "com.caddyserver.http.network"
-	LabelUpstreamPort = "com.caddyserver.http.upstream.port"
+	PlaceholderContainerName = "docker.upstream.container_name"
+	PlaceholderContainerID   = "docker.upstream.container_id"
+	PlaceholderPathPrefix    = "docker.upstream.path_prefix"
+	PlaceholderStrippedPath  = "docker.upstream.stripped_path"
+
+	// The prefix of the placeholders of the container labels, e.g.
+	// {docker.upstream.labels.com.example.service}.
+	PlaceholderLabelsPrefix = "docker.upstream.labels."
+)
+
+// placeholderMatchedLabels holds the labels of the matched containers,
+// which provide the placeholders with PlaceholderLabelsPrefix.
+const placeholderMatchedLabels = "docker.upstream.matched_labels"
+
+const (
+	BackendDocker = "docker"
+	BackendPodman = "podman"
+
+	// The socket of the rootful podman service.
+	defaultPodmanHost = "unix:///run/podman/podman.sock"
+)
+
+// composeProjectLabel is the label of the docker compose project name.
+const composeProjectLabel = "com.docker.compose.project"
+
+// stackNamespaceLabel is the label of the docker stack name, which is set on the swarm services.
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+const (
+	minRetryInterval        = 500 * time.Millisecond
+	defaultMaxRetryInterval = 30 * time.Second
+	defaultRequestTimeout   = 10 * time.Second
+	defaultRefreshDebounce  = 200 * time.Millisecond
+	defaultProvisionRetries = 3
+
+	// The maximum weight of the upstreams, which are duplicated by their weight.
+	maxWeight = 100
+
+	// The consecutive refresh failures before monitoring the events again.
+	maxRefreshFailures = 3
+
+	// The debounce periods after the first pending event before refreshing the
+	// candidates anyway, the events of a busy docker host may never pause.
+	maxDebouncePeriods = 5
 )
 
 func init() {
 	caddy.RegisterModule(Upstreams{})
 }
 
+// dockerHost is a docker server which the containers are discovered from.
+type dockerHost struct {
+	// The host from the config, empty for the DOCKER_HOST environment variable.
+	name string
+	cli  Client
+
+	// The key of the shared client in the clients pool, empty if the client is not shared.
+	poolKey string
+
+	// The watcher of the host, which is shared in the watchers pool with the
+	// key, empty if the watcher is not shared.
+	watcher  *watcher
+	watchKey string
+	sub      *subscriber
+
+	// The version of the containers which the candidates are provisioned from, guarded by refreshMu.
+	version int
+
+	// The number of enabled containers, guarded by candidatesMu.
+	containers int
+}
+
 type candidate struct {
+	// The name of the docker host which the container runs on.
+	host string
+
+	id       string
+	name     string
+	labels   map[string]string
 	matchers caddyhttp.MatcherSet
-	upstream *reverseproxy.Upstream
-}
 
-var (
-	candidates   []candidate
-	candidatesMu sync.RWMutex
-)
+	// One upstream per port of the container.
+	upstreams []*reverseproxy.Upstream
 
-var defaultFilters = filters.NewArgs(
-	filters.Arg("label", fmt.Sprintf("%s=true", LabelEnable)),
-	filters.Arg("status", "running"), // types.ContainerState.Status
-	filters.Arg("health", types.Healthy),
-	filters.Arg("health", types.NoHealthcheck),
-)
+	// The scheme is only informative, upstream sources provide dial addresses
+	// and TLS to the upstream is enabled by the transport of reverse_proxy.
+	scheme string
+
+	// The upstreams are returned weight times, so the load balancing policies
+	// like random and round_robin choose it proportionally.
+	weight int
+
+	// The active health checks of reverse_proxy don't apply to dynamic upstreams,
+	// the health check path is only recorded for the operators.
+	healthPath string
+
+	// The prefix of the path matcher like /api/*, without the wildcard and the trailing slash.
+	pathPrefix string
+
+	// Whether the path prefix is stripped in the stripped path placeholder.
+	stripPrefix bool
+
+	// Like the scheme, whether the upstream speaks h2c is only informative,
+	// the HTTP versions are decided by the transport of reverse_proxy.
+	h2c bool
+
+	// Like the h2c hint, the dial timeout is set by the transport of reverse_proxy.
+	dialTimeout time.Duration
+}
 
 // Upstreams provides upstreams from the docker host.
-type Upstreams struct{}
+type Upstreams struct {
+	// The URL to the docker server, e.g. `unix:///var/run/docker.sock`.
+	// Defaults to the `DOCKER_HOST` environment variable.
+	Host string `json:"host,omitempty"`
+
+	// The URLs to more docker servers, the containers of all the servers
+	// are discovered as the upstreams.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// The paths to the TLS files used to connect to the docker server.
+	// If all of them are empty, `DOCKER_CERT_PATH` and `DOCKER_TLS_VERIFY`
+	// environment variables are used.
+	TLSCACert string `json:"tls_ca_cert,omitempty"`
+	TLSCert   string `json:"tls_cert,omitempty"`
+	TLSKey    string `json:"tls_key,omitempty"`
+
+	// The docker API version to use. The version is negotiated with
+	// the docker server if empty.
+	APIVersion string `json:"api_version,omitempty"`
+
+	// Whether to skip the containers which are unhealthy or still starting.
+	// Default: true
+	RequireHealthy *bool `json:"require_healthy,omitempty"`
+
+	// The container engine serving the docker API, `docker` or `podman`,
+	// which decides the default socket and the events to monitor.
+	// Default: docker
+	Backend string `json:"backend,omitempty"`
+
+	// The kind of docker objects to discover, `containers` lists the standalone
+	// containers and `swarm` lists the tasks of the swarm services.
+	// Default: containers
+	Mode string `json:"mode,omitempty"`
+
+	// The prefix of the labels to read, which allows multiple caddy instances
+	// to discover the containers of the same docker host independently.
+	// Default: com.caddyserver.http
+	LabelPrefix string `json:"label_prefix,omitempty"`
+
+	// The maximum interval between the retries to monitor the docker events,
+	// the interval starts from 500ms and doubles on every consecutive failure.
+	// Default: 30s
+	MaxRetryInterval caddy.Duration `json:"max_retry_interval,omitempty"`
+
+	// The extra labels which the discovered containers must have, they are
+	// applied by the docker server when listing the containers.
+	ExtraLabelFilters map[string]string `json:"extra_label_filters,omitempty"`
+
+	// The docker network whose containers are all discovered, without the enable
+	// label unless it is set to false. Only supported by the containers mode.
+	Network string `json:"network,omitempty"`
+
+	// The glob patterns of the names or the ids of the containers to discover,
+	// and of those to skip, which take precedence.
+	IncludeNames []string `json:"include_names,omitempty"`
+	ExcludeNames []string `json:"exclude_names,omitempty"`
+
+	// The named lists of hosts, which are referenced by the host matcher labels
+	// like `@group` to avoid repeating the long lists of hosts.
+	HostGroups map[string][]string `json:"host_groups,omitempty"`
+
+	// The docker compose project which the discovered containers must belong to.
+	ComposeProject string `json:"compose_project,omitempty"`
+
+	// The number of retries to ping the docker server and list the containers
+	// during the provisioning, the interval starts from 500ms and doubles on
+	// every attempt.
+	// Default: 3
+	ProvisionRetries *int `json:"provision_retries,omitempty"`
+
+	// Whether to fail the provisioning if any docker server is unavailable.
+	// If false, no upstreams of the server are provided until it is reachable.
+	// By default, the provisioning fails only if all the docker servers are
+	// unavailable, which is the only server unless the hosts are set.
+	FailFast *bool `json:"fail_fast,omitempty"`
+
+	// Whether to re-list the containers when they are connected to or
+	// disconnected from the docker networks.
+	WatchNetworkEvents bool `json:"watch_network_events,omitempty"`
+
+	// The interval to re-list the containers regardless of the docker events,
+	// in case that any event is missed. Disabled if zero.
+	PollInterval caddy.Duration `json:"poll_interval,omitempty"`
+
+	// The quiet period after the last docker event before the containers are
+	// listed again, so a burst of events like a flapping health check results
+	// in a single refresh. The containers are listed at the latest 5 periods
+	// after the first event, even if the events never pause.
+	// Default: 200ms
+	RefreshDebounce caddy.Duration `json:"refresh_debounce,omitempty"`
+
+	// The ip address to reach the docker host, which is dialed for the
+	// published ports and the containers using the host network.
+	// Default: 127.0.0.1
+	HostIP string `json:"host_ip,omitempty"`
+
+	// The timeout of the requests to the docker server, except the long-lived
+	// request monitoring the events.
+	// Default: 10s
+	RequestTimeout caddy.Duration `json:"request_timeout,omitempty"`
+
+	// The ip address family of the container networks to dial, `auto` prefers
+	// the IPv4 address and falls back to the IPv6 address.
+	// Default: auto
+	AddressFamily string `json:"address_family,omitempty"`
+
+	// The port to dial the containers without the port label, either
+	// a number or a service name like `http`.
+	DefaultPort string `json:"default_port,omitempty"`
+
+	// Whether to replace the global placeholders like {env.SITE_DOMAIN} in the
+	// label values, the values with literal braces may be changed.
+	ExpandLabels bool `json:"expand_labels,omitempty"`
+
+	// Whether to fail the provisioning if any enabled container has invalid
+	// labels, instead of logging and skipping the container.
+	StrictLabels bool `json:"strict_labels,omitempty"`
+
+	// Creates the client of the docker host, e.g. with a fake client or another
+	// backend in the programs embedding the module. Defaults to the docker client.
+	NewClient func(host string) (Client, error) `json:"-"`
+
+	hosts  []*dockerHost
+	logger *zap.Logger
+
+	candidates   []candidate
+	candidatesMu *sync.RWMutex
+
+	// Serializes the refreshes triggered by the events and the polling.
+	refreshMu *sync.Mutex
+}
 
 func (Upstreams) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -58,168 +305,1094 @@ func (Upstreams) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-func (u *Upstreams) provisionCandidates(ctx caddy.Context, cli *client.Client) error {
-	containers, err := cli.ContainerList(ctx, container.ListOptions{Filters: defaultFilters})
+// labelKey returns the key of the label under the configured prefix.
+func (u *Upstreams) labelKey(key string) string {
+	return u.LabelPrefix + strings.TrimPrefix(key, DefaultLabelPrefix)
+}
+
+// normalizeLabels rewrites the labels under the configured prefix to the default
+// prefix, so they could be read by the Label* constants.
+func (u *Upstreams) normalizeLabels(labels map[string]string) map[string]string {
+	if u.LabelPrefix == DefaultLabelPrefix {
+		return labels
+	}
+
+	normalized := make(map[string]string, len(labels))
+	for key, value := range labels {
+		switch {
+		case strings.HasPrefix(key, u.LabelPrefix+"."):
+			normalized[DefaultLabelPrefix+strings.TrimPrefix(key, u.LabelPrefix)] = value
+		case strings.HasPrefix(key, DefaultLabelPrefix+"."):
+			// Labels of other caddy instances.
+		default:
+			normalized[key] = value
+		}
+	}
+	return normalized
+}
+
+// labelFilters returns the label filters of the enabled containers.
+func (u *Upstreams) labelFilters() filters.Args {
+	// The value of the enable label is checked by listContainers.
+	args := filters.NewArgs()
+	if u.Network != "" {
+		args.Add("network", u.Network)
+	} else {
+		args.Add("label", u.labelKey(LabelEnable))
+	}
+	for key, value := range u.ExtraLabelFilters {
+		args.Add("label", fmt.Sprintf("%s=%s", key, value))
+	}
+	if u.ComposeProject != "" {
+		args.Add("label", fmt.Sprintf("%s=%s", composeProjectLabel, u.ComposeProject))
+	}
+	return args
+}
+
+func (u *Upstreams) listFilters() filters.Args {
+	args := u.labelFilters()
+	args.Add("status", "running") // types.ContainerState.Status
+	if u.RequireHealthy == nil || *u.RequireHealthy {
+		args.Add("health", types.Healthy)
+		args.Add("health", types.NoHealthcheck)
+	}
+	return args
+}
+
+// eventFilters selects the events which could change the candidates.
+func (u *Upstreams) eventFilters() filters.Args {
+	args := filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", string(events.ActionStart)),
+		filters.Arg("event", string(events.ActionDie)),
+		filters.Arg("event", string(events.ActionDestroy)),
+		filters.Arg("event", string(events.ActionPause)),
+		filters.Arg("event", string(events.ActionUnPause)),
+		filters.Arg("event", string(events.ActionHealthStatus)),
+	)
+	if u.WatchNetworkEvents {
+		// The container address changes without any container event.
+		args.Add("type", string(events.NetworkEventType))
+		args.Add("event", string(events.ActionConnect))
+		args.Add("event", string(events.ActionDisconnect))
+	}
+	if u.Mode == ModeSwarm {
+		args.Add("type", string(events.ServiceEventType))
+		args.Add("event", string(events.ActionCreate))
+		args.Add("event", string(events.ActionUpdate))
+		args.Add("event", string(events.ActionRemove))
+	}
+	if u.Backend == BackendPodman {
+		// The actions of podman like the health status events don't match the
+		// docker event filters, monitor all of them since the refreshes are debounced.
+		for _, action := range args.Get("event") {
+			args.Del("event", action)
+		}
+	}
+	return args
+}
+
+// listContainers lists the containers by the filters of the docker server,
+// which are shared by the modules of the same watcher.
+func (u *Upstreams) listContainers(ctx context.Context, cli ContainerLister) ([]types.Container, error) {
+	if u.Mode == ModeSwarm {
+		return u.listTasks(ctx, cli)
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{Filters: u.listFilters()})
 	if err != nil {
-		return fmt.Errorf("listing docker containers: %w", err)
+		return nil, fmt.Errorf("listing docker containers: %w", err)
 	}
+	return containers, nil
+}
 
-	updated := make([]candidate, 0, len(containers))
+// enabledContainers returns the enabled containers of the listed containers,
+// which are not modified since they are shared with the other modules.
+func (u *Upstreams) enabledContainers(containers []types.Container) []types.Container {
+	var repl *caddy.Replacer
+	if u.ExpandLabels {
+		repl = caddy.NewReplacer()
+	}
 
+	enabled := make([]types.Container, 0, len(containers))
 	for _, c := range containers {
-		// Build matchers.
-		matchers := buildMatchers(ctx, c.Labels)
+		// Regardless of the filters, e.g. the tasks are listed by their desired state.
+		if c.State != "running" {
+			continue
+		}
+		c.Labels = u.normalizeLabels(c.Labels)
+		if repl != nil {
+			c.Labels = expandLabels(repl, c.Labels)
+		}
+		if !u.includeContainer(c) {
+			continue
+		}
 
-		// Build upstream.
-		port, ok := c.Labels[LabelUpstreamPort]
-		if !ok {
-			ctx.Logger().Error("unable to get port from container labels",
-				zap.String("container_id", c.ID),
-			)
+		value, ok := c.Labels[LabelEnable]
+		if isEnabled(value) || (!ok && u.Network != "") {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled
+}
+
+// includeContainer reports whether the name or the id of the container matches the include
+// patterns, if any, and doesn't match the exclude patterns.
+func (u *Upstreams) includeContainer(c types.Container) bool {
+	name := containerName(c)
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, c.ID); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if matches(u.ExcludeNames) {
+		return false
+	}
+	return len(u.IncludeNames) == 0 || matches(u.IncludeNames)
+}
+
+// resolveHostGroups replaces the references like @group in the host matcher labels
+// with the hosts of the group.
+func (u *Upstreams) resolveHostGroups(labels map[string]string) (map[string]string, error) {
+	var resolved map[string]string
+	for _, key := range []string{LabelMatchHost, labelMatchNotPrefix + "host"} {
+		value, ok := labels[key]
+		if !ok || !strings.Contains(value, "@") {
 			continue
 		}
 
-		// Choose network to connect.
-		if len(c.NetworkSettings.Networks) == 0 {
-			ctx.Logger().Error("unable to get ip address from container networks",
+		values, err := splitValues(value)
+		if err != nil {
+			return nil, err
+		}
+
+		var hosts []string
+		for _, host := range values {
+			name, ok := strings.CutPrefix(host, "@")
+			if !ok {
+				hosts = append(hosts, host)
+				continue
+			}
+			group, ok := u.HostGroups[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown host group %q in %s label", name, key)
+			}
+			hosts = append(hosts, group...)
+		}
+
+		if resolved == nil {
+			resolved = make(map[string]string, len(labels))
+			for k, v := range labels {
+				resolved[k] = v
+			}
+		}
+		// Encode the hosts as a JSON array, which keeps any comma in the hosts.
+		encoded, err := json.Marshal(hosts)
+		if err != nil {
+			return nil, err
+		}
+		resolved[key] = string(encoded)
+	}
+
+	if resolved == nil {
+		return labels, nil
+	}
+	return resolved, nil
+}
+
+// expandLabels replaces the global placeholders like {env.SITE_DOMAIN} in the values of
+// the labels under the default prefix, the unknown placeholders are kept.
+func expandLabels(repl *caddy.Replacer, labels map[string]string) map[string]string {
+	expanded := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if strings.HasPrefix(key, DefaultLabelPrefix+".") {
+			value = repl.ReplaceKnown(value, "")
+		}
+		expanded[key] = value
+	}
+	return expanded
+}
+
+// isEnabled reports whether the value of the enable label is truthy,
+// e.g. `true`, `1`, `yes` or `on`.
+func isEnabled(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "on":
+		return true
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+	return err == nil && enabled
+}
+
+// pathPrefix returns the prefix of the path matcher value ending with the wildcard,
+// e.g. /api for /api/*.
+func pathPrefix(path string) string {
+	prefix, ok := strings.CutSuffix(path, "*")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(prefix, "/")
+}
+
+// stripPathPrefix removes the prefix from the path, keeping the leading slash.
+func stripPathPrefix(path, prefix string) string {
+	// Compare the bytes of the path covered by the prefix, the lowercased
+	// strings could differ in length from the original ones.
+	if len(path) < len(prefix) || !strings.EqualFold(path[:len(prefix)], prefix) {
+		return path
+	}
+	path = path[len(prefix):]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// containerName returns the name of the container without the leading slash. The names
+// also include the legacy links like /web/db, which are aliases in other containers.
+func containerName(c types.Container) string {
+	for _, name := range c.Names {
+		name = strings.TrimPrefix(name, "/")
+		if !strings.Contains(name, "/") {
+			return name
+		}
+	}
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribe refreshes the candidates whenever the watcher of the host lists the containers again.
+func (u *Upstreams) subscribe(ctx caddy.Context, h *dockerHost) {
+	h.sub = &subscriber{
+		refresh: func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, err := u.provisionCandidates(ctx, h); err != nil {
+				ctx.Logger().Error("unable to provision the candidates", zap.Error(err))
+			}
+		},
+		evict: u.evictCandidate,
+	}
+
+	u.refreshMu.Lock()
+	version := h.version
+	u.refreshMu.Unlock()
+	h.watcher.subscribe(h.sub, version)
+}
+
+// provisionCandidates replaces the candidates by the containers listed by the watcher,
+// it returns the number of containers with invalid labels, which are logged.
+func (u *Upstreams) provisionCandidates(ctx caddy.Context, h *dockerHost) (int, error) {
+	u.refreshMu.Lock()
+	defer u.refreshMu.Unlock()
+
+	containers, version, err := h.watcher.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	h.version = version
+	containers = u.enabledContainers(containers)
+
+	// The matchers of the unchanged containers are reused, provisioning
+	// matchers like expression is expensive.
+	previous := make(map[string]candidate)
+	u.candidatesMu.RLock()
+	for _, c := range u.candidates {
+		previous[c.id] = c
+	}
+	u.candidatesMu.RUnlock()
+
+	updated := make([]candidate, 0, len(containers))
+	invalid := 0
+
+	for _, c := range containers {
+		if value, ok := c.Labels[LabelReady]; ok && !isEnabled(value) {
+			// Kept out of the upstreams on purpose, not an invalid container.
+			ctx.Logger().Debug("container not ready",
 				zap.String("container_id", c.ID),
+				zap.String("ready", value),
 			)
 			continue
 		}
 
-		network, ok := c.Labels[LabelNetwork]
-		if !ok {
-			// Use the first network settings of container.
-			for _, settings := range c.NetworkSettings.Networks {
-				address := net.JoinHostPort(settings.IPAddress, port)
-				updated = append(updated, candidate{
-					matchers: matchers,
-					upstream: &reverseproxy.Upstream{Dial: address},
-				})
-				break
+		// Build matchers.
+		var matchers caddyhttp.MatcherSet
+		var err error
+		if prev, ok := previous[c.ID]; ok && equalLabels(prev.labels, c.Labels) {
+			matchers = prev.matchers
+		} else {
+			var labels map[string]string
+			labels, err = u.resolveHostGroups(c.Labels)
+			if err == nil {
+				matchers, err = buildMatchers(ctx, labels)
 			}
+		}
+		if err != nil {
+			// Skip the container, an incomplete matcher set would route more traffic than intended.
+			ctx.Logger().Error("unable to build matchers from container labels",
+				zap.String("container_id", c.ID),
+				zap.Error(err),
+			)
+			invalid++
 			continue
 		}
 
-		settings, ok := c.NetworkSettings.Networks[network]
-		if !ok {
-			// Add project prefix. See also https://github.com/compose-spec/compose-go/blob/main/loader/normalize.go.
-			const projectLabel = "com.docker.compose.project"
-			project, ok := c.Labels[projectLabel]
-			if !ok {
-				ctx.Logger().Error("unable to get network settings from container",
+		scheme := u.detectScheme(c)
+		if value, ok := c.Labels[LabelUpstreamScheme]; ok {
+			if value != "http" && value != "https" {
+				ctx.Logger().Error("invalid upstream scheme from container labels",
 					zap.String("container_id", c.ID),
-					zap.String("network", network),
+					zap.String("scheme", value),
 				)
+				invalid++
 				continue
 			}
+			scheme = value
+		}
 
-			network = fmt.Sprintf("%s_%s", project, network)
-			settings, ok = c.NetworkSettings.Networks[network]
-			if !ok {
-				ctx.Logger().Error("unable to get network settings from container",
+		weight := 1
+		if value, ok := c.Labels[LabelUpstreamWeight]; ok {
+			weight, err = strconv.Atoi(value)
+			if err != nil || weight <= 0 {
+				ctx.Logger().Warn("invalid upstream weight from container labels",
 					zap.String("container_id", c.ID),
-					zap.String("network", network),
+					zap.String("weight", value),
 				)
+				invalid++
 				continue
 			}
+			if weight > maxWeight {
+				// Each request copies the upstreams weight times.
+				ctx.Logger().Warn("upstream weight from container labels exceeds the maximum",
+					zap.String("container_id", c.ID),
+					zap.Int("weight", weight),
+					zap.Int("max_weight", maxWeight),
+				)
+				weight = maxWeight
+			}
+		}
+
+		healthPath := c.Labels[LabelHealthPath]
+		if healthPath != "" && !strings.HasPrefix(healthPath, "/") {
+			ctx.Logger().Warn("invalid health check path from container labels",
+				zap.String("container_id", c.ID),
+				zap.String("path", healthPath),
+			)
+			invalid++
+			healthPath = ""
+		}
+
+		h2c := false
+		if value, ok := c.Labels[LabelUpstreamH2C]; ok {
+			h2c, err = strconv.ParseBool(value)
+			if err != nil {
+				ctx.Logger().Warn("invalid upstream h2c from container labels",
+					zap.String("container_id", c.ID),
+					zap.String("h2c", value),
+				)
+				invalid++
+				h2c = false
+			}
+		}
+
+		stripPrefix := false
+		if value, ok := c.Labels[LabelUpstreamStripPrefix]; ok {
+			stripPrefix, err = strconv.ParseBool(value)
+			if err != nil {
+				ctx.Logger().Warn("invalid upstream strip prefix from container labels",
+					zap.String("container_id", c.ID),
+					zap.String("strip_prefix", value),
+				)
+				invalid++
+				stripPrefix = false
+			}
+		}
+
+		var dialTimeout time.Duration
+		if value, ok := c.Labels[LabelUpstreamDialTimeout]; ok {
+			dialTimeout, err = caddy.ParseDuration(value)
+			if err != nil || dialTimeout < 0 {
+				ctx.Logger().Warn("invalid upstream dial timeout from container labels",
+					zap.String("container_id", c.ID),
+					zap.String("dial_timeout", value),
+				)
+				invalid++
+				dialTimeout = 0
+			}
+		}
+
+		maxRequests := 0
+		if value, ok := c.Labels[LabelUpstreamMaxRequests]; ok {
+			maxRequests, err = strconv.Atoi(value)
+			if err != nil || maxRequests < 0 {
+				ctx.Logger().Warn("invalid upstream max requests from container labels",
+					zap.String("container_id", c.ID),
+					zap.String("max_requests", value),
+				)
+				invalid++
+				maxRequests = 0
+			}
+		}
+
+		// Build upstream.
+		addresses, err := u.upstreamAddresses(c)
+		if err != nil {
+			ctx.Logger().Error("unable to get upstream address from container",
+				zap.String("container_id", c.ID),
+				zap.Error(err),
+			)
+			invalid++
+			continue
+		}
+
+		upstreams := make([]*reverseproxy.Upstream, 0, len(addresses))
+		for _, address := range addresses {
+			upstreams = append(upstreams, &reverseproxy.Upstream{Dial: address, MaxRequests: maxRequests})
 		}
 
-		address := net.JoinHostPort(settings.IPAddress, port)
 		updated = append(updated, candidate{
-			matchers: matchers,
-			upstream: &reverseproxy.Upstream{Dial: address},
+			host:        h.name,
+			id:          c.ID,
+			name:        containerName(c),
+			labels:      c.Labels,
+			matchers:    matchers,
+			upstreams:   upstreams,
+			scheme:      scheme,
+			weight:      weight,
+			healthPath:  healthPath,
+			h2c:         h2c,
+			dialTimeout: dialTimeout,
+			pathPrefix:  pathPrefix(c.Labels[LabelMatchPath]),
+			stripPrefix: stripPrefix,
 		})
 	}
 
-	candidatesMu.Lock()
-	candidates = updated
-	candidatesMu.Unlock()
+	u.logChanges(ctx, h, previous, updated)
 
-	return nil
+	u.candidatesMu.Lock()
+	// Keep the candidates of the other docker hosts.
+	for _, c := range u.candidates {
+		if c.host != h.name {
+			updated = append(updated, c)
+		}
+	}
+	// The containers are listed in any order, sort them once for the load balancing
+	// policies like first, which rely on the order of the upstreams.
+	sort.Slice(updated, func(i, j int) bool { return updated[i].id < updated[j].id })
+	u.candidates = updated
+	h.containers = len(containers)
+	u.candidatesMu.Unlock()
+
+	return invalid, nil
 }
 
-func (u *Upstreams) keepUpdated(ctx caddy.Context, cli *client.Client) {
-	defer cli.Close()
+// logChanges logs the containers added to and removed from the candidates of the docker host.
+func (u *Upstreams) logChanges(ctx caddy.Context, h *dockerHost, previous map[string]candidate, updated []candidate) {
+	current := make(map[string]bool, len(updated))
+	for _, c := range updated {
+		current[c.id] = true
+		if _, ok := previous[c.id]; !ok {
+			ctx.Logger().Info("container added",
+				zap.String("docker_host", h.name),
+				zap.String("container_id", c.id),
+				zap.String("container_name", c.name),
+			)
+		}
+	}
+	for _, c := range previous {
+		if c.host == h.name && !current[c.id] {
+			ctx.Logger().Info("container removed",
+				zap.String("docker_host", h.name),
+				zap.String("container_id", c.id),
+				zap.String("container_name", c.name),
+			)
+		}
+	}
+}
 
-	debounced := debounce.New(100 * time.Millisecond)
+// evictCandidate removes the candidate of the container id, if any.
+func (u *Upstreams) evictCandidate(id string) {
+	u.candidatesMu.Lock()
+	defer u.candidatesMu.Unlock()
 
-	for {
-		messages, errs := cli.Events(ctx, types.EventsOptions{
-			Filters: filters.NewArgs(filters.Arg("type", string(events.ContainerEventType))),
-		})
+	for i, c := range u.candidates {
+		if c.id != id {
+			continue
+		}
 
-	selectLoop:
-		for {
-			select {
-			case <-messages:
-				debounced(func() {
-					err := u.provisionCandidates(ctx, cli)
-					if err != nil {
-						ctx.Logger().Error("unable to provision the candidates", zap.Error(err))
-					}
-				})
-			case err := <-errs:
-				if errors.Is(err, context.Canceled) {
-					return
-				}
+		u.candidates = append(u.candidates[:i:i], u.candidates[i+1:]...)
+		// The next refresh doesn't list the container, so the removal is logged here.
+		u.logger.Info("container removed",
+			zap.String("docker_host", c.host),
+			zap.String("container_id", c.id),
+			zap.String("container_name", c.name),
+		)
+		return
+	}
+}
+
+// debouncer runs the last function once the calls pause for the delay,
+// or once the max wait passed since the first pending call.
+type debouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	maxWait time.Duration
+	timer   *time.Timer
+	first   time.Time
+}
+
+func newDebouncer(delay, maxWait time.Duration) func(f func()) {
+	d := &debouncer{delay: delay, maxWait: maxWait}
+	return d.call
+}
+
+func (d *debouncer) call(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if d.timer == nil {
+		d.first = now
+	} else {
+		d.timer.Stop()
+	}
+
+	wait := d.delay
+	if remaining := d.maxWait - now.Sub(d.first); remaining < wait {
+		wait = remaining
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		// A stopped timer may fire anyway, the next call has replaced it then.
+		if d.timer != timer {
+			d.mu.Unlock()
+			return
+		}
+		d.timer = nil
+		d.mu.Unlock()
+		f()
+	})
+	d.timer = timer
+}
 
-				ctx.Logger().Warn("unable to monitor container events; will retry", zap.Error(err))
-				break selectLoop
+// jitter returns a random duration in [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// provision pings the docker server of the host and lists its containers,
+// it returns the number of containers with invalid labels.
+func (u *Upstreams) provision(ctx caddy.Context, h *dockerHost) (int, error) {
+	logger := ctx.Logger().With(zap.String("docker_host", h.name))
+
+	// The docker server is pinged until it is reachable, then the containers are listed,
+	// unless they are listed already by the watcher shared with the previous config.
+	connected := h.watcher.isListed()
+	try := func() (int, error) {
+		if !connected {
+			pingCtx, cancel := context.WithTimeout(ctx, time.Duration(u.RequestTimeout))
+			ping, err := h.cli.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				return 0, fmt.Errorf("ping docker server: %w", checkSocket(h.cli.DaemonHost(), err))
 			}
+			connected = true
+			// The version is negotiated lazily otherwise, negotiate it now to log the version in effect.
+			// It is a no-op if the version is set by the api_version option or DOCKER_API_VERSION.
+			h.cli.NegotiateAPIVersionPing(ping)
+			logger.Info("connected docker server",
+				zap.String("api_version", ping.APIVersion),
+				zap.String("client_api_version", h.cli.ClientVersion()),
+			)
 		}
+		if !h.watcher.isListed() {
+			if err := h.watcher.refresh(ctx); err != nil {
+				return 0, err
+			}
+		}
+		return u.provisionCandidates(ctx, h)
+	}
 
+	invalid, err := try()
+
+	// Smooth over the transient failures, e.g. the docker server is still starting.
+	retryInterval := minRetryInterval
+	for attempt := 1; err != nil && attempt <= u.provisionRetries(); attempt++ {
+		wait := jitter(retryInterval)
+		logger.Warn("unable to provision the candidates; retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("wait", wait),
+			zap.Error(err),
+		)
 		select {
 		case <-ctx.Done():
-			return
-		case <-time.After(500 * time.Millisecond):
+			return 0, ctx.Err()
+		case <-time.After(wait):
 		}
+		retryInterval *= 2
+
+		invalid, err = try()
 	}
+	return invalid, err
 }
 
-func (u *Upstreams) provision(ctx caddy.Context, cli *client.Client) error {
-	err := u.provisionCandidates(ctx, cli)
-	if err != nil {
-		return err
+func (u *Upstreams) Provision(ctx caddy.Context) error {
+	upstreamsMetrics.init.Do(initUpstreamsMetrics)
+	u.candidatesMu = new(sync.RWMutex)
+	u.refreshMu = new(sync.Mutex)
+	u.logger = ctx.Logger()
+
+	if u.LabelPrefix == "" {
+		u.LabelPrefix = DefaultLabelPrefix
+	}
+	u.LabelPrefix = strings.TrimSuffix(u.LabelPrefix, ".")
+
+	if u.HostIP == "" {
+		u.HostIP = "127.0.0.1"
+	}
+	if net.ParseIP(u.HostIP) == nil {
+		return fmt.Errorf("invalid host ip %q", u.HostIP)
+	}
+
+	if u.DefaultPort != "" {
+		port, err := net.LookupPort("tcp", u.DefaultPort)
+		if err != nil {
+			return fmt.Errorf("invalid default port %q: %w", u.DefaultPort, err)
+		}
+		u.DefaultPort = strconv.Itoa(port)
 	}
 
-	go u.keepUpdated(ctx, cli)
+	if u.RequestTimeout <= 0 {
+		u.RequestTimeout = caddy.Duration(defaultRequestTimeout)
+	}
+
+	if u.RefreshDebounce <= 0 {
+		u.RefreshDebounce = caddy.Duration(defaultRefreshDebounce)
+	}
+
+	if u.MaxRetryInterval <= 0 {
+		u.MaxRetryInterval = caddy.Duration(defaultMaxRetryInterval)
+	}
+
+	switch u.Mode {
+	case "":
+		u.Mode = ModeContainers
+	case ModeContainers, ModeSwarm:
+	default:
+		return fmt.Errorf("unrecognized mode %q", u.Mode)
+	}
+	switch u.AddressFamily {
+	case "":
+		u.AddressFamily = AddressFamilyAuto
+	case AddressFamilyAuto, AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		return fmt.Errorf("unrecognized address family %q", u.AddressFamily)
+	}
+
+	for _, pattern := range append(u.IncludeNames, u.ExcludeNames...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid name pattern %q: %w", pattern, err)
+		}
+	}
+
+	switch u.Backend {
+	case "":
+		u.Backend = BackendDocker
+	case BackendDocker, BackendPodman:
+	default:
+		return fmt.Errorf("unrecognized backend %q", u.Backend)
+	}
+	if u.Backend == BackendPodman && u.Mode == ModeSwarm {
+		return errors.New("mode swarm is not supported by backend podman")
+	}
+
+	if u.Network != "" && u.Mode != ModeContainers {
+		return fmt.Errorf("network is not supported by mode %q", u.Mode)
+	}
+
+	host := u.Host
+	if host == "" && u.Backend == BackendPodman && os.Getenv(client.EnvOverrideHost) == "" {
+		host = defaultPodmanHost
+	}
+
+	names := u.Hosts
+	if host != "" || len(names) == 0 {
+		names = append([]string{host}, names...)
+	}
+
+	// All the hosts are created before monitoring any of them, the refreshes
+	// of a host read the other hosts.
+	for _, name := range names {
+		h := &dockerHost{name: name}
+		var err error
+		if u.NewClient != nil {
+			h.cli, err = u.NewClient(name)
+		} else {
+			// The clients are shared with the modules of the previous config on reloads.
+			h.poolKey = u.clientKey(name)
+			h.cli, err = loadClient(h.poolKey, func() (Client, error) { return u.newClient(name) })
+		}
+		if err != nil {
+			return err
+		}
+		u.hosts = append(u.hosts, h)
+
+		// The watchers are shared with the modules of the previous config on reloads,
+		// so the events are not monitored again.
+		if h.poolKey != "" {
+			h.watchKey, err = u.watchKey(h)
+			if err != nil {
+				return err
+			}
+			h.watcher, err = loadWatcher(h.watchKey, func() *watcher { return newWatcher(name, h.cli, u.watchOptions()) })
+			if err != nil {
+				return err
+			}
+		} else {
+			h.watcher = newWatcher(name, h.cli, u.watchOptions())
+		}
+	}
+
+	failed := make(map[*dockerHost]error)
+	for _, h := range u.hosts {
+		invalid, err := u.provision(ctx, h)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if len(u.hosts) > 1 {
+				err = fmt.Errorf("docker host %q: %w", h.name, err)
+			}
+			failed[h] = err
+		}
+		if invalid > 0 && u.StrictLabels {
+			return fmt.Errorf("%d enabled containers have invalid labels", invalid)
+		}
+	}
+	if len(failed) > 0 && u.failFast(len(failed)) {
+		errs := make([]error, 0, len(failed))
+		for _, h := range u.hosts {
+			if err, ok := failed[h]; ok {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	// The unavailable hosts are retried by the watchers monitoring their events.
+	for _, h := range u.hosts {
+		if err, ok := failed[h]; ok {
+			ctx.Logger().Warn("unable to provision the candidates; will retry",
+				zap.String("docker_host", h.name),
+				zap.Error(err),
+			)
+		}
+		u.subscribe(ctx, h)
+		h.watcher.start()
+	}
+	registerInstance(u)
 
 	return nil
 }
 
-func (u *Upstreams) Provision(ctx caddy.Context) error {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return fmt.Errorf("provisioning docker client: %w", err)
+// clientKey returns the key of the shared client of the host, the clients
+// are shared only if all the client options are the same.
+func (u *Upstreams) clientKey(host string) string {
+	return strings.Join([]string{host, u.APIVersion, u.TLSCACert, u.TLSCert, u.TLSKey}, "|")
+}
+
+// newClient returns the docker client of the host, the environment variables
+// are used if the host is empty.
+func (u *Upstreams) newClient(host string) (Client, error) {
+	opts := []client.Opt{client.FromEnv}
+	if u.APIVersion != "" {
+		opts = append(opts, client.WithVersion(u.APIVersion))
+	} else {
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	}
+	if u.TLSCACert != "" || u.TLSCert != "" || u.TLSKey != "" {
+		opts = append(opts, client.WithTLSClientConfig(u.TLSCACert, u.TLSCert, u.TLSKey))
 	}
 
-	ping, err := cli.Ping(ctx)
+	addr := host
+	if addr == "" {
+		addr = os.Getenv(client.EnvOverrideHost)
+	}
+	if addr != "" {
+		// Connect through the ssh command for hosts like ssh://user@host.
+		helper, err := connhelper.GetConnectionHelper(addr)
+		if err != nil {
+			return nil, fmt.Errorf("provisioning connection helper for host %q: %w", addr, err)
+		}
+		if helper != nil {
+			opts = append(opts,
+				client.WithHTTPClient(&http.Client{Transport: &http.Transport{DialContext: helper.Dialer}}),
+				client.WithHost(helper.Host),
+				client.WithDialContext(helper.Dialer),
+			)
+		} else if host != "" {
+			opts = append(opts, client.WithHost(host))
+		}
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
-		return fmt.Errorf("ping docker server: %w", err)
+		if host != "" {
+			return nil, fmt.Errorf("provisioning docker client for host %q: %w", host, err)
+		}
+		return nil, fmt.Errorf("provisioning docker client: %w", err)
+	}
+	return cli, nil
+}
+
+// checkSocket returns a friendlier error than err if the unix socket of the docker host doesn't exist.
+func checkSocket(host string, err error) error {
+	path, ok := strings.CutPrefix(host, "unix://")
+	if !ok {
+		return err
+	}
+	if _, statErr := os.Stat(path); errors.Is(statErr, fs.ErrNotExist) {
+		return fmt.Errorf("docker socket %s not found; is the path mounted into the container? %w", path, err)
+	}
+	return err
+}
+
+func (u *Upstreams) provisionRetries() int {
+	if u.ProvisionRetries == nil {
+		return defaultProvisionRetries
+	}
+	return *u.ProvisionRetries
+}
+
+// failFast reports whether the provisioning fails with the given number of
+// unavailable docker hosts. By default, the provisioning fails only if all
+// the hosts are unavailable, so an unreachable host doesn't affect the others.
+func (u *Upstreams) failFast(failed int) bool {
+	if u.FailFast != nil {
+		return *u.FailFast
 	}
-	ctx.Logger().Info("connected docker server", zap.String("api_version", ping.APIVersion))
+	return failed == len(u.hosts)
+}
+
+// Cleanup releases the watchers and the docker clients, the events are no longer
+// monitored once the last module sharing the watcher is cleaned up.
+func (u *Upstreams) Cleanup() error {
+	unregisterInstance(u)
+
+	var errs []error
+	for _, h := range u.hosts {
+		if h.watcher != nil {
+			h.watcher.unsubscribe(h.sub)
+			if h.watchKey != "" {
+				if _, err := watchers.Delete(h.watchKey); err != nil {
+					errs = append(errs, err)
+				}
+			} else {
+				_ = h.watcher.Destruct()
+			}
+		}
 
-	return u.provision(ctx, cli)
+		var err error
+		if h.poolKey != "" {
+			_, err = clients.Delete(h.poolKey)
+		} else {
+			err = h.cli.Close()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// GetUpstreams returns the upstreams of the containers matching r. An upstream source only
+// decides where the request is proxied to, the request itself like its headers is modified by
+// the handlers of reverse_proxy (e.g. header_up), which could read the placeholders set here.
 func (u *Upstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
 	upstreams := make([]*reverseproxy.Upstream, 0, 1)
 
-	candidatesMu.RLock()
-	defer candidatesMu.RUnlock()
+	u.candidatesMu.RLock()
+	defer u.candidatesMu.RUnlock()
+
+	// Containers could share the same address, e.g. with host networking.
+	dials := make(map[string]struct{})
+
+	debug := u.logger.Core().Enabled(zap.DebugLevel)
 
-	for _, c := range candidates {
-		if c.matchers.Match(r) {
-			upstreams = append(upstreams, c.upstream)
+	var names, ids []string
+	var labels []map[string]string
+	var prefixes []string
+	var rejections []string
+	strippedPath := r.URL.Path
+	stripped := false
+
+	for _, c := range u.candidates {
+		if !c.matchers.Match(r) {
+			if debug {
+				rejections = append(rejections, u.logMismatch(r, c))
+			}
+			continue
+		}
+		if debug {
+			u.logger.Debug("container matched",
+				zap.String("container_id", c.id),
+				zap.String("container_name", c.name),
+			)
+		}
+
+		names = append(names, c.name)
+		ids = append(ids, c.id)
+		labels = append(labels, c.labels)
+		if c.pathPrefix != "" {
+			prefixes = append(prefixes, c.pathPrefix)
+			if c.stripPrefix && !stripped {
+				strippedPath, stripped = stripPathPrefix(r.URL.Path, c.pathPrefix), true
+			}
+		}
+
+		for _, upstream := range c.upstreams {
+			if _, ok := dials[upstream.Dial]; ok {
+				continue
+			}
+			dials[upstream.Dial] = struct{}{}
+
+			for i := 0; i < c.weight; i++ {
+				upstreams = append(upstreams, upstream)
+			}
+		}
+	}
+
+	if len(upstreams) == 0 {
+		upstreamsMetrics.unmatchedRequests.Inc()
+		if debug {
+			// Summarize why the request would be answered by 502.
+			u.logger.Debug("no container matched",
+				zap.Int("candidates", len(u.candidates)),
+				zap.String("host", r.Host),
+				zap.String("uri", r.RequestURI),
+				zap.Strings("rejections", rejections),
+			)
 		}
 	}
 
+	// The upstream is chosen by the load balancing policy afterwards,
+	// so the placeholders list all the matched containers.
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set(PlaceholderContainerName, strings.Join(names, ","))
+		repl.Set(PlaceholderContainerID, strings.Join(ids, ","))
+		repl.Set(PlaceholderPathPrefix, strings.Join(prefixes, ","))
+		repl.Set(PlaceholderStrippedPath, strippedPath)
+		setLabelsPlaceholders(repl, labels)
+	}
+
 	return upstreams, nil
 }
 
+// matchedLabels holds the labels of the containers matched by a request, the
+// labels placeholders are replaced lazily since few configs read them.
+type matchedLabels struct {
+	labels []map[string]string
+}
+
+// setLabelsPlaceholders provides the placeholders of the labels, the provider is
+// registered once per request and the labels are replaced on every call.
+func setLabelsPlaceholders(repl *caddy.Replacer, labels []map[string]string) {
+	if v, ok := repl.Get(placeholderMatchedLabels); ok {
+		if m, ok := v.(*matchedLabels); ok {
+			m.labels = labels
+			return
+		}
+	}
+	m := &matchedLabels{labels: labels}
+	repl.Set(placeholderMatchedLabels, m)
+	repl.Map(m.replace)
+}
+
+// replace returns the distinct values of the label of the matched containers,
+// which are comma separated.
+func (m *matchedLabels) replace(key string) (any, bool) {
+	name, ok := strings.CutPrefix(key, PlaceholderLabelsPrefix)
+	if !ok {
+		return nil, false
+	}
+
+	var values []string
+next:
+	for _, l := range m.labels {
+		value, ok := l[name]
+		if !ok {
+			continue
+		}
+		for _, v := range values {
+			if v == value {
+				continue next
+			}
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return nil, false
+	}
+	return strings.Join(values, ","), true
+}
+
+// String hides the internal placeholder of the matched labels.
+func (m *matchedLabels) String() string {
+	return ""
+}
+
+// logMismatch logs the first matcher of the candidate which doesn't match r,
+// and returns the name of the container with the label of the matcher.
+func (u *Upstreams) logMismatch(r *http.Request, c candidate) string {
+	for _, m := range c.matchers {
+		if m.Match(r) {
+			continue
+		}
+
+		fields := []zap.Field{
+			zap.String("container_id", c.id),
+			zap.String("container_name", c.name),
+			zap.String("host", r.Host),
+			zap.String("method", r.Method),
+			zap.String("uri", r.RequestURI),
+		}
+		rejection := c.name
+		if lm, ok := m.(labeledMatcher); ok {
+			fields = append(fields, zap.String("label", lm.key), zap.String("value", lm.value))
+			rejection = fmt.Sprintf("%s: %s=%s", c.name, lm.key, lm.value)
+		}
+		u.logger.Debug("container not matched", fields...)
+		return rejection
+	}
+	return c.name
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Upstreams)(nil)
+	_ caddy.CleanerUpper          = (*Upstreams)(nil)
 	_ reverseproxy.UpstreamSource = (*Upstreams)(nil)
 )
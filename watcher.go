@@ -0,0 +1,339 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"go.uber.org/zap"
+)
+
+// watchers holds the watchers shared by the upstreams modules, so the events are
+// monitored once per docker host and the containers are not listed again while
+// the config is reloaded.
+var watchers = caddy.NewUsagePool()
+
+// watcher monitors the events of a docker host and keeps the containers listed
+// with the options of the modules sharing it, which build their candidates from
+// the listed containers.
+type watcher struct {
+	cli Client
+
+	// The options to list the containers and to monitor the events, which are
+	// the same for all the modules sharing the watcher.
+	opts *Upstreams
+
+	logger    *zap.Logger
+	ctx       context.Context
+	cancel    context.CancelFunc
+	startOnce sync.Once
+
+	// Held while listing the containers.
+	refreshMu sync.Mutex
+
+	mu          sync.RWMutex
+	containers  []types.Container
+	version     int
+	listed      bool
+	lastRefresh time.Time
+	lastError   string
+	lastErrorAt time.Time
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber is notified by the watcher once the containers are listed again,
+// or once a container dies before the containers are listed again.
+type subscriber struct {
+	refresh func()
+	evict   func(id string)
+}
+
+// watchOptions returns the options of u which the watcher depends on.
+func (u *Upstreams) watchOptions() *Upstreams {
+	return &Upstreams{
+		RequireHealthy:     u.RequireHealthy,
+		Backend:            u.Backend,
+		Mode:               u.Mode,
+		LabelPrefix:        u.LabelPrefix,
+		MaxRetryInterval:   u.MaxRetryInterval,
+		ExtraLabelFilters:  u.ExtraLabelFilters,
+		Network:            u.Network,
+		ComposeProject:     u.ComposeProject,
+		WatchNetworkEvents: u.WatchNetworkEvents,
+		PollInterval:       u.PollInterval,
+		RefreshDebounce:    u.RefreshDebounce,
+		RequestTimeout:     u.RequestTimeout,
+	}
+}
+
+// watchKey returns the key of the shared watcher of the host, the watchers are
+// shared only if the client and the watch options are the same.
+func (u *Upstreams) watchKey(h *dockerHost) (string, error) {
+	opts, err := json.Marshal(u.watchOptions())
+	if err != nil {
+		return "", err
+	}
+	return h.poolKey + "|" + string(opts), nil
+}
+
+func newWatcher(name string, cli Client, opts *Upstreams) *watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watcher{
+		cli:  cli,
+		opts: opts,
+		// The loggers of a config are closed once it is unloaded, the watcher may outlive it.
+		logger:      caddy.Log().Named("http.reverse_proxy.upstreams.docker").With(zap.String("docker_host", name)),
+		ctx:         ctx,
+		cancel:      cancel,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+func loadWatcher(key string, newWatcher func() *watcher) (*watcher, error) {
+	value, _, err := watchers.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return newWatcher(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*watcher), nil
+}
+
+// Destruct stops monitoring the events once the last module is cleaned up.
+func (w *watcher) Destruct() error {
+	w.cancel()
+	return nil
+}
+
+// start monitors the events, and polls the containers if enabled, unless started already.
+func (w *watcher) start() {
+	w.startOnce.Do(func() {
+		go w.keepUpdated()
+		if w.opts.PollInterval > 0 {
+			go w.keepPolling()
+		}
+	})
+}
+
+func (w *watcher) unsubscribe(s *subscriber) {
+	w.mu.Lock()
+	delete(w.subscribers, s)
+	w.mu.Unlock()
+}
+
+// notify calls f for every subscriber, without holding the lock since the
+// subscribers read the containers.
+func (w *watcher) notify(f func(s *subscriber)) {
+	w.mu.RLock()
+	subscribers := make([]*subscriber, 0, len(w.subscribers))
+	for s := range w.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	w.mu.RUnlock()
+
+	for _, s := range subscribers {
+		f(s)
+	}
+}
+
+// snapshot returns the listed containers with their version, which is increased
+// on every change, or the last error if the containers have never been listed.
+func (w *watcher) snapshot() ([]types.Container, int, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if !w.listed {
+		if w.lastError == "" {
+			return nil, 0, errors.New("containers not listed yet")
+		}
+		return nil, 0, errors.New(w.lastError)
+	}
+	return w.containers, w.version, nil
+}
+
+// subscribe adds the subscriber, which is notified at once if the containers
+// changed since the version it has read.
+func (w *watcher) subscribe(s *subscriber, version int) {
+	w.mu.Lock()
+	w.subscribers[s] = struct{}{}
+	changed := w.listed && w.version != version
+	w.mu.Unlock()
+
+	if changed {
+		s.refresh()
+	}
+}
+
+// status returns the time of the last successful refresh and the last error.
+func (w *watcher) status() (time.Time, string, time.Time) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lastRefresh, w.lastError, w.lastErrorAt
+}
+
+func (w *watcher) isListed() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.listed
+}
+
+// refresh lists the containers again and notifies the subscribers.
+func (w *watcher) refresh(ctx context.Context) error {
+	w.refreshMu.Lock()
+	listCtx, cancel := context.WithTimeout(ctx, time.Duration(w.opts.RequestTimeout))
+	containers, err := w.opts.listContainers(listCtx, w.cli)
+	cancel()
+
+	w.mu.Lock()
+	if err != nil {
+		w.lastError, w.lastErrorAt = err.Error(), time.Now()
+	} else {
+		w.containers, w.listed, w.lastRefresh = containers, true, time.Now()
+		w.version++
+	}
+	w.mu.Unlock()
+	w.refreshMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	w.notify(func(s *subscriber) { s.refresh() })
+	return nil
+}
+
+// evict removes the container from the listed containers and the candidates of
+// the subscribers before the containers are listed again.
+func (w *watcher) evict(id string) {
+	w.mu.Lock()
+	for i, c := range w.containers {
+		if c.ID == id {
+			// The slice is shared with the readers of the snapshot.
+			w.containers = append(w.containers[:i:i], w.containers[i+1:]...)
+			w.version++
+			break
+		}
+	}
+	w.mu.Unlock()
+
+	w.notify(func(s *subscriber) { s.evict(id) })
+}
+
+func (w *watcher) keepUpdated() {
+	delay := time.Duration(w.opts.RefreshDebounce)
+	debounced := newDebouncer(delay, maxDebouncePeriods*delay)
+
+	retryInterval := minRetryInterval
+
+	// The consecutive failures of the refreshes triggered by the events.
+	var failures atomic.Int32
+	resubscribe := make(chan struct{}, 1)
+
+	for {
+		eventsCtx, cancel := context.WithCancel(w.ctx)
+		messages, errs := w.cli.Events(eventsCtx, types.EventsOptions{Filters: w.opts.eventFilters()})
+
+	selectLoop:
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					// A closed channel is always ready to receive, resubscribe instead of spinning.
+					w.logger.Warn("container events closed; will retry")
+					break selectLoop
+				}
+				retryInterval = minRetryInterval
+				if msg.Type == events.ContainerEventType && msg.Action == events.ActionDie {
+					// Stop routing to the container before the containers are listed again.
+					w.evict(msg.Actor.ID)
+				}
+				debounced(func() {
+					if w.ctx.Err() != nil {
+						return
+					}
+					upstreamsMetrics.refreshes.Inc()
+					err := w.refresh(w.ctx)
+					if err == nil {
+						failures.Store(0)
+						return
+					}
+
+					upstreamsMetrics.refreshErrors.Inc()
+					if failures.Add(1) < maxRefreshFailures {
+						w.logger.Warn("unable to list the containers", zap.Error(err))
+						return
+					}
+
+					// The next event may never come, the containers are listed
+					// again after monitoring the events again.
+					w.logger.Error("unable to list the containers repeatedly; will resubscribe to the events",
+						zap.Int32("failures", failures.Load()),
+						zap.Error(err),
+					)
+					select {
+					case resubscribe <- struct{}{}:
+					default:
+					}
+				})
+			case <-resubscribe:
+				failures.Store(0)
+				break selectLoop
+			case err, ok := <-errs:
+				if !ok {
+					w.logger.Warn("container events closed; will retry")
+					break selectLoop
+				}
+				if errors.Is(err, context.Canceled) {
+					cancel()
+					return
+				}
+
+				w.logger.Warn("unable to monitor container events; will retry", zap.Error(err))
+				break selectLoop
+			}
+		}
+		cancel()
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(jitter(retryInterval)):
+		}
+
+		// The events are missed while not monitoring.
+		if err := w.refresh(w.ctx); err != nil {
+			w.logger.Error("unable to list the containers", zap.Error(err))
+		}
+
+		retryInterval *= 2
+		if retryInterval > time.Duration(w.opts.MaxRetryInterval) {
+			retryInterval = time.Duration(w.opts.MaxRetryInterval)
+		}
+	}
+}
+
+func (w *watcher) keepPolling() {
+	ticker := time.NewTicker(time.Duration(w.opts.PollInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.refresh(w.ctx); err != nil {
+				w.logger.Error("unable to list the containers", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Destructor = (*watcher)(nil)
+)